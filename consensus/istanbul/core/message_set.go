@@ -17,29 +17,115 @@
 package core
 
 import (
+	"errors"
 	"fmt"
+	"math/big"
 	"strings"
 	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/crypto/bls/blscrypto"
 )
 
+// errInvalidCommittedSeal is returned when a message's CommittedSeal is
+// present but isn't the right length to be a serialized BLS signature.
+var errInvalidCommittedSeal = errors.New("invalid committed seal length")
+
+// MessageSet is the common surface that roundState and the rest of core need
+// from a collection of per-validator consensus messages for a round. It is
+// implemented by messageSet (classic Istanbul) and qbftMessageSet (QBFT), so
+// that which concrete type backs a round is purely a construction-time
+// decision driven by the chain config's fork block (see newMessageSetFor).
+type MessageSet interface {
+	Add(msg *istanbul.Message) error
+	Get(addr common.Address) *istanbul.Message
+	Values() []*istanbul.Message
+	Size() int
+	Remove(address common.Address)
+	GetAddressIndex(addr common.Address) (uint64, error)
+	GetAddressPublicKey(addr common.Address) ([]byte, error)
+	ValSetSize() uint64
+
+	// Aggregate, Weight and HasQuorum are implemented by both messageSet
+	// and qbftMessageSet, so activating the QBFT fork doesn't regress
+	// callers doing aggregate-signature or weighted-quorum math.
+	Aggregate() (sig []byte, bitmap *big.Int, count int)
+	Weight() *big.Int
+	HasQuorum(threshold *big.Int) bool
+}
+
+// newMessageSetFor returns the MessageSet implementation appropriate for the
+// round: the classic Istanbul messageSet, or qbftMessageSet once the QBFT
+// fork is active. Callers (typically the backend, driven off the chain
+// config's QibftBlock) decide forkActive once per height and pass it down,
+// so core itself stays written against the MessageSet interface. round is
+// only used by the QBFT variant, whose commit seal domain includes it.
+//
+// NOT YET WIRED UP: nothing in this tree calls newMessageSetFor with
+// forkActive derived from a chain config yet. The intended call site is
+// the backend's per-height round-state construction (wherever it currently
+// always builds a classic messageSet), checking the chain config's
+// QibftBlock against the height being started. That backend code lives
+// outside consensus/istanbul/core and isn't part of this change.
+func newMessageSetFor(valSet istanbul.ValidatorSet, round *big.Int, forkActive bool) MessageSet {
+	if forkActive {
+		return newQBFTMessageSet(valSet, round)
+	}
+	return newMessageSet(valSet)
+}
+
 // Construct a new message set to accumulate messages for given sequence/view number.
 func newMessageSet(valSet istanbul.ValidatorSet) *messageSet {
 	return &messageSet{
 		messagesMu: new(sync.Mutex),
 		messages:   make(map[common.Address]*istanbul.Message),
 		valSet:     valSet,
+		bitmap:     new(big.Int),
+		sigs:       make(map[common.Address]blscrypto.SerializedSignature),
 	}
 }
 
+// BatchVerifier verifies a batch of Istanbul messages with a single
+// aggregated BLS signature check rather than one pairing check per message.
+// It is swappable so that core tests can supply a stub that always succeeds
+// (or deliberately fails) without pulling in the full BLS implementation.
+type BatchVerifier interface {
+	// VerifyBatch verifies the signatures on msgs as a single aggregated
+	// operation and returns the addresses whose signature did not verify.
+	// A non-nil error indicates the batch could not be checked at all (e.g.
+	// a malformed public key), in which case bad is not meaningful and the
+	// caller should fall back to per-message verification.
+	VerifyBatch(msgs []*istanbul.Message) (bad []common.Address, err error)
+}
+
 // ----------------------------------------------------------------------------
 
 type messageSet struct {
-	valSet     istanbul.ValidatorSet
-	messagesMu *sync.Mutex
-	messages   map[common.Address]*istanbul.Message
+	valSet        istanbul.ValidatorSet
+	messagesMu    *sync.Mutex
+	messages      map[common.Address]*istanbul.Message
+	batchVerifier BatchVerifier
+	pending       []*istanbul.Message
+
+	// aggSig, bitmap and sigs let callers pull a ready-to-broadcast
+	// aggregate BLS seal straight off the set instead of re-aggregating
+	// Values() on every quorum check. sigs retains each contributing
+	// validator's individual signature so Remove (rare) can rebuild the
+	// aggregate from what's left, while Add (hot path) only ever combines
+	// the one new signature in.
+	aggSig blscrypto.SerializedSignature
+	bitmap *big.Int
+	sigs   map[common.Address]blscrypto.SerializedSignature
+}
+
+// SetBatchVerifier installs the verifier used by AddDeferred/FlushVerify. If
+// unset, AddDeferred falls back to verifying each message individually as it
+// is added.
+func (ms *messageSet) SetBatchVerifier(v BatchVerifier) {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+	ms.batchVerifier = v
 }
 
 func (ms *messageSet) Add(msg *istanbul.Message) error {
@@ -53,6 +139,88 @@ func (ms *messageSet) Add(msg *istanbul.Message) error {
 	return ms.addVerifiedMessage(msg)
 }
 
+// AddDeferred checks that msg comes from a known validator but defers the
+// (expensive) signature check until FlushVerify is called, so that many
+// messages collected in a short window can be verified in a single batched
+// BLS operation instead of one at a time.
+func (ms *messageSet) AddDeferred(msg *istanbul.Message) error {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+
+	if _, v := ms.valSet.GetByAddress(msg.Address); v == nil {
+		return istanbul.ErrUnauthorizedAddress
+	}
+
+	if ms.batchVerifier == nil {
+		if err := ms.verify(msg); err != nil {
+			return err
+		}
+		return ms.addVerifiedMessage(msg)
+	}
+
+	ms.pending = append(ms.pending, msg)
+	return nil
+}
+
+// FlushVerify runs a single batched signature verification over every
+// message queued by AddDeferred since the last flush. Messages that verify
+// are promoted into the set; bad returns the addresses whose signature
+// failed so the caller can evict them (e.g. drop the peer). If the batch
+// check itself errors out (rather than reporting bad signers), FlushVerify
+// falls back to verifying each pending message individually so that one
+// malformed batch input does not stall the whole set.
+func (ms *messageSet) FlushVerify() (bad []common.Address, err error) {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+
+	if len(ms.pending) == 0 {
+		return nil, nil
+	}
+
+	pending := ms.pending
+	ms.pending = nil
+
+	if ms.batchVerifier == nil {
+		for _, msg := range pending {
+			if err := ms.verify(msg); err != nil {
+				bad = append(bad, msg.Address)
+				continue
+			}
+			ms.addVerifiedMessage(msg)
+		}
+		return bad, nil
+	}
+
+	bad, err = ms.batchVerifier.VerifyBatch(pending)
+	if err != nil {
+		// A single bad signature (or a batch verifier that can't pinpoint
+		// the offender) shouldn't poison every message in the batch: fall
+		// back to checking them one at a time.
+		bad = nil
+		for _, msg := range pending {
+			if verr := ms.verify(msg); verr != nil {
+				bad = append(bad, msg.Address)
+				continue
+			}
+			ms.addVerifiedMessage(msg)
+		}
+		return bad, nil
+	}
+
+	badSet := make(map[common.Address]bool, len(bad))
+	for _, addr := range bad {
+		badSet[addr] = true
+	}
+	for _, msg := range pending {
+		if badSet[msg.Address] {
+			continue
+		}
+		ms.addVerifiedMessage(msg)
+	}
+
+	return bad, nil
+}
+
 func (ms *messageSet) GetAddressIndex(addr common.Address) (uint64, error) {
 	ms.messagesMu.Lock()
 	defer ms.messagesMu.Unlock()
@@ -86,6 +254,120 @@ func (ms *messageSet) Remove(address common.Address) {
 	defer ms.messagesMu.Unlock()
 
 	delete(ms.messages, address)
+
+	// Also drop any not-yet-flushed AddDeferred message from address, so an
+	// eviction between AddDeferred and the next FlushVerify isn't undone by
+	// the flush promoting the buffered message anyway.
+	if len(ms.pending) > 0 {
+		filtered := ms.pending[:0]
+		for _, msg := range ms.pending {
+			if msg.Address != address {
+				filtered = append(filtered, msg)
+			}
+		}
+		ms.pending = filtered
+	}
+
+	if _, ok := ms.sigs[address]; !ok {
+		return
+	}
+	delete(ms.sigs, address)
+
+	if idx, v := ms.valSet.GetByAddress(address); v != nil {
+		ms.bitmap.SetBit(ms.bitmap, idx, 0)
+	}
+
+	// Removal is rare (an equivocating or since-evicted validator), so
+	// rebuilding from the remaining per-address signatures is simpler and
+	// cheap enough compared to maintaining a subtractable aggregate.
+	ms.rebuildAggregateLocked()
+}
+
+// Aggregate returns the current aggregated BLS signature over every
+// well-formed committed seal added so far, alongside the bitmap of
+// contributing validator indices and the number of contributors; messages
+// without a committed seal are not counted. It is safe to call repeatedly as messages
+// arrive; the aggregate is maintained incrementally rather than recomputed.
+func (ms *messageSet) Aggregate() (sig []byte, bitmap *big.Int, count int) {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+
+	return ms.aggSig[:], new(big.Int).Set(ms.bitmap), len(ms.sigs)
+}
+
+// addToAggregate folds msg's committed seal into the running aggregate
+// signature and bitmap in O(1), without re-aggregating every previously
+// known signature. It is a no-op for messages that don't carry a BLS
+// committed seal (e.g. PRE-PREPARE), for addresses already accounted for,
+// and for malformed seals. A seal that fails to combine into the aggregate
+// is never inserted into sigs/bitmap, so Aggregate()'s count can't drift
+// ahead of what it actually represents. Must be called with messagesMu
+// held.
+func (ms *messageSet) addToAggregate(msg *istanbul.Message) {
+	if len(msg.CommittedSeal) == 0 {
+		return
+	}
+
+	var sig blscrypto.SerializedSignature
+	if len(msg.CommittedSeal) != len(sig) {
+		return
+	}
+	copy(sig[:], msg.CommittedSeal)
+
+	idx, v := ms.valSet.GetByAddress(msg.Address)
+	if v == nil {
+		return
+	}
+	if _, ok := ms.sigs[msg.Address]; ok {
+		return
+	}
+
+	newAgg, err := ms.combineLocked(sig)
+	if err != nil {
+		return
+	}
+
+	ms.sigs[msg.Address] = sig
+	ms.bitmap.SetBit(ms.bitmap, idx, 1)
+	ms.aggSig = newAgg
+}
+
+// combineLocked returns the result of folding sig into the current
+// aggregate: a single two-element BLS aggregation rather than
+// re-aggregating the whole sigs map, so Add stays O(1) regardless of how
+// many signatures the set already holds. Must be called with messagesMu
+// held.
+func (ms *messageSet) combineLocked(sig blscrypto.SerializedSignature) (blscrypto.SerializedSignature, error) {
+	if len(ms.sigs) == 0 {
+		return sig, nil
+	}
+	return blscrypto.AggregateSignatures([]blscrypto.SerializedSignature{ms.aggSig, sig})
+}
+
+// rebuildAggregateLocked recomputes aggSig from the currently known
+// per-address signatures. It is only used by Remove: eviction is rare
+// enough that a full O(n) rebuild there is cheaper than maintaining a
+// subtractable aggregate, unlike the hot Add path above. Must be called
+// with messagesMu held.
+func (ms *messageSet) rebuildAggregateLocked() {
+	if len(ms.sigs) == 0 {
+		ms.aggSig = blscrypto.SerializedSignature{}
+		return
+	}
+
+	sigs := make([]blscrypto.SerializedSignature, 0, len(ms.sigs))
+	for _, s := range ms.sigs {
+		sigs = append(sigs, s)
+	}
+
+	aggSig, err := blscrypto.AggregateSignatures(sigs)
+	if err != nil {
+		// Leave aggSig at its last known-good value; every signature here
+		// already passed combineLocked when it was added, so this should
+		// only fail on data corruption.
+		return
+	}
+	ms.aggSig = aggSig
 }
 
 func (ms *messageSet) Values() (result []*istanbul.Message) {
@@ -105,6 +387,30 @@ func (ms *messageSet) Size() int {
 	return len(ms.messages)
 }
 
+// Weight returns the combined voting weight of every validator that has
+// contributed a message to the set, as reported by the validator set's
+// WeightOf accessor. Until a weighted-voting upgrade is activated this is
+// expected to be equivalent to Size() (each validator weighted 1), but
+// callers doing quorum math should prefer Weight/HasQuorum over Size so that
+// switching on weighted voting is a config change rather than a rewrite.
+func (ms *messageSet) Weight() *big.Int {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+
+	weight := new(big.Int)
+	for addr := range ms.messages {
+		weight.Add(weight, ms.valSet.WeightOf(addr))
+	}
+	return weight
+}
+
+// HasQuorum reports whether the combined weight of contributing validators
+// meets or exceeds threshold (e.g. 2f+1 or ceil(2N/3), computed by the
+// caller from ValSetSize/WeightOf).
+func (ms *messageSet) HasQuorum(threshold *big.Int) bool {
+	return ms.Weight().Cmp(threshold) >= 0
+}
+
 func (ms *messageSet) Get(addr common.Address) *istanbul.Message {
 	ms.messagesMu.Lock()
 	defer ms.messagesMu.Unlock()
@@ -118,11 +424,35 @@ func (ms *messageSet) verify(msg *istanbul.Message) error {
 	if _, v := ms.valSet.GetByAddress(msg.Address); v == nil {
 		return istanbul.ErrUnauthorizedAddress
 	}
-	return nil
+	return ms.verifySealLocked(msg)
+}
+
+// verifySealLocked authenticates msg's BLS committed seal against the
+// sender's registered public key. Messages with no committed seal (e.g.
+// PRE-PREPARE) have nothing for this set to check beyond sender membership;
+// their transport-level signature was already validated when the message
+// was decoded off the wire. Must be called with messagesMu held.
+func (ms *messageSet) verifySealLocked(msg *istanbul.Message) error {
+	if len(msg.CommittedSeal) == 0 {
+		return nil
+	}
+
+	var sig blscrypto.SerializedSignature
+	if len(msg.CommittedSeal) != len(sig) {
+		return errInvalidCommittedSeal
+	}
+	copy(sig[:], msg.CommittedSeal)
+
+	_, v := ms.valSet.GetByAddress(msg.Address)
+	if v == nil {
+		return istanbul.ErrUnauthorizedAddress
+	}
+	return blscrypto.VerifySignature(v.BLSPublicKey(), msg.Hash().Bytes(), sig)
 }
 
 func (ms *messageSet) addVerifiedMessage(msg *istanbul.Message) error {
 	ms.messages[msg.Address] = msg
+	ms.addToAggregate(msg)
 	return nil
 }
 
@@ -0,0 +1,215 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/crypto/bls/blscrypto"
+)
+
+// fakeValidator implements the full istanbul.Validator interface so that
+// *fakeValidatorSet can stand in anywhere a real validator set is expected,
+// not just at the handful of call sites message_set.go/qbft_message_set.go
+// happen to use today.
+type fakeValidator struct {
+	address common.Address
+	blsKey  []byte
+}
+
+func (v *fakeValidator) Address() common.Address { return v.address }
+func (v *fakeValidator) String() string           { return v.address.String() }
+func (v *fakeValidator) BLSPublicKey() []byte     { return v.blsKey }
+
+// fakeValidatorSet implements the full istanbul.ValidatorSet interface for
+// exercising messageSet/qbftMessageSet in isolation, without pulling in a
+// real validator set implementation. Proposer selection is stubbed to the
+// simplest behavior that satisfies the interface (first validator in
+// insertion order is always proposer), and AddValidators/RemoveValidators
+// simply append or delete entries (added validators get weight 1), since
+// nothing in this package's tests depends on proposer rotation.
+type fakeValidatorSet struct {
+	order   []common.Address
+	byAddr  map[common.Address]*fakeValidator
+	weights map[common.Address]*big.Int
+}
+
+// newFakeValidatorSet builds a set where every validator has equal weight 1
+// and a stand-in BLS public key from newFakeBLSPublicKey. Tests that sign a
+// real committed seal must install a key from newBLSKeyPair themselves.
+func newFakeValidatorSet(addrs ...common.Address) *fakeValidatorSet {
+	weights := make([]*big.Int, len(addrs))
+	for i := range weights {
+		weights[i] = big.NewInt(1)
+	}
+	return newFakeValidatorSetWeighted(addrs, weights)
+}
+
+// newFakeValidatorSetWeighted is like newFakeValidatorSet but lets the
+// caller assign each validator its own weight, for tests that need to
+// distinguish stake-weighted quorum from a plain headcount.
+func newFakeValidatorSetWeighted(addrs []common.Address, weights []*big.Int) *fakeValidatorSet {
+	if len(addrs) != len(weights) {
+		panic("newFakeValidatorSetWeighted: addrs and weights must be the same length")
+	}
+	vs := &fakeValidatorSet{
+		byAddr:  make(map[common.Address]*fakeValidator, len(addrs)),
+		weights: make(map[common.Address]*big.Int, len(addrs)),
+	}
+	for i, addr := range addrs {
+		vs.order = append(vs.order, addr)
+		vs.byAddr[addr] = &fakeValidator{address: addr, blsKey: newFakeBLSPublicKey(addr)}
+		vs.weights[addr] = weights[i]
+	}
+	return vs
+}
+
+func (vs *fakeValidatorSet) Size() int { return len(vs.order) }
+
+func (vs *fakeValidatorSet) List() []istanbul.Validator {
+	list := make([]istanbul.Validator, 0, len(vs.order))
+	for _, addr := range vs.order {
+		list = append(list, vs.byAddr[addr])
+	}
+	return list
+}
+
+func (vs *fakeValidatorSet) GetByIndex(i uint64) istanbul.Validator {
+	if i >= uint64(len(vs.order)) {
+		return nil
+	}
+	return vs.byAddr[vs.order[i]]
+}
+
+func (vs *fakeValidatorSet) GetByAddress(addr common.Address) (int, istanbul.Validator) {
+	v, ok := vs.byAddr[addr]
+	if !ok {
+		return 0, nil
+	}
+	for i, a := range vs.order {
+		if a == addr {
+			return i, v
+		}
+	}
+	return 0, nil
+}
+
+func (vs *fakeValidatorSet) ContainsByAddress(addr common.Address) (bool, istanbul.Validator) {
+	_, v := vs.GetByAddress(addr)
+	return v != nil, v
+}
+
+func (vs *fakeValidatorSet) GetProposer() istanbul.Validator {
+	if len(vs.order) == 0 {
+		return nil
+	}
+	return vs.byAddr[vs.order[0]]
+}
+
+func (vs *fakeValidatorSet) IsProposer(addr common.Address) bool {
+	return len(vs.order) > 0 && vs.order[0] == addr
+}
+
+func (vs *fakeValidatorSet) CalcProposer(lastProposer common.Address, round uint64) istanbul.Validator {
+	return vs.GetProposer()
+}
+
+func (vs *fakeValidatorSet) AddValidators(validators []istanbul.ValidatorData) bool {
+	for _, data := range validators {
+		if _, ok := vs.byAddr[data.Address]; ok {
+			continue
+		}
+		vs.order = append(vs.order, data.Address)
+		vs.byAddr[data.Address] = &fakeValidator{address: data.Address, blsKey: newFakeBLSPublicKey(data.Address)}
+		vs.weights[data.Address] = big.NewInt(1)
+	}
+	return true
+}
+
+func (vs *fakeValidatorSet) RemoveValidators(addrs []common.Address) bool {
+	for _, addr := range addrs {
+		delete(vs.byAddr, addr)
+		delete(vs.weights, addr)
+		for i, a := range vs.order {
+			if a == addr {
+				vs.order = append(vs.order[:i], vs.order[i+1:]...)
+				break
+			}
+		}
+	}
+	return true
+}
+
+func (vs *fakeValidatorSet) Copy() istanbul.ValidatorSet {
+	cp := &fakeValidatorSet{
+		order:   append([]common.Address(nil), vs.order...),
+		byAddr:  make(map[common.Address]*fakeValidator, len(vs.byAddr)),
+		weights: make(map[common.Address]*big.Int, len(vs.weights)),
+	}
+	for addr, v := range vs.byAddr {
+		cloned := *v
+		cp.byAddr[addr] = &cloned
+	}
+	for addr, w := range vs.weights {
+		cp.weights[addr] = new(big.Int).Set(w)
+	}
+	return cp
+}
+
+// F returns the maximum number of faulty validators this set can tolerate
+// under the classic 3f+1 assumption.
+func (vs *fakeValidatorSet) F() int { return (len(vs.order) - 1) / 3 }
+
+// MinQuorumSize returns n - F(), which equals the classic 2f+1 quorum size
+// when n = 3f+1.
+func (vs *fakeValidatorSet) MinQuorumSize() int { return len(vs.order) - vs.F() }
+
+func (vs *fakeValidatorSet) Policy() istanbul.ProposerPolicy { return istanbul.RoundRobin }
+
+func (vs *fakeValidatorSet) WeightOf(addr common.Address) *big.Int {
+	if w, ok := vs.weights[addr]; ok {
+		return w
+	}
+	return new(big.Int)
+}
+
+// newFakeBLSPublicKey derives a deterministic-but-distinct stand-in BLS
+// public key for addr. Real tests that need a committed seal to actually
+// verify use newBLSKeyPair instead and overwrite the validator's blsKey
+// with the matching generated public key.
+func newFakeBLSPublicKey(addr common.Address) []byte {
+	return append([]byte(nil), addr.Bytes()...)
+}
+
+// newBLSKeyPair generates a real BLS private/public key pair, for tests
+// that need verifySealLocked/qbftMessageSet.verify to do a genuine
+// signature check rather than take the empty-seal early return. Callers
+// sign with priv and install pub as the corresponding fakeValidator's
+// blsKey so the two actually match.
+func newBLSKeyPair() (priv *blscrypto.PrivateKey, pub []byte, err error) {
+	priv, err = blscrypto.GenerateBLSPrivateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err = priv.ToPublic()
+	if err != nil {
+		return nil, nil, err
+	}
+	return priv, pub, nil
+}
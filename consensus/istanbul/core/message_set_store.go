@@ -0,0 +1,285 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/crypto/bls/blscrypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// messageSetStorePrefix namespaces the in-flight message sets within the
+// node's key-value store so DeleteBelow/Compact can range over just this
+// data without touching unrelated keys.
+var messageSetStorePrefix = []byte("istanbul-msgset-")
+
+// messageSetRLP is the on-disk representation of a messageSet: the address
+// -> message map isn't directly RLP-encodable, so it is flattened to a
+// slice. valSet is intentionally not persisted; it is re-supplied by the
+// caller on load (see MessageSetStore.Get) since it may have rotated across
+// an epoch boundary since the snapshot was written.
+type messageSetRLP struct {
+	Messages []*istanbul.Message
+}
+
+// EncodeRLP implements rlp.Encoder so a messageSet can be handed straight to
+// a MessageSetStore after every successful Add.
+func (ms *messageSet) EncodeRLP(w io.Writer) error {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+
+	msgs := make([]*istanbul.Message, 0, len(ms.messages))
+	for _, msg := range ms.messages {
+		msgs = append(msgs, msg)
+	}
+	return rlp.Encode(w, &messageSetRLP{Messages: msgs})
+}
+
+// DecodeRLP implements rlp.Decoder. The decoded set has no valSet and an
+// empty aggregate; callers must assign valSet and re-add the messages (or
+// call rehydrate) before using it, since membership may need re-checking.
+func (ms *messageSet) DecodeRLP(s *rlp.Stream) error {
+	var dec messageSetRLP
+	if err := s.Decode(&dec); err != nil {
+		return err
+	}
+
+	ms.messagesMu = new(sync.Mutex)
+	ms.messages = make(map[common.Address]*istanbul.Message, len(dec.Messages))
+	ms.bitmap = new(big.Int)
+	ms.sigs = make(map[common.Address]blscrypto.SerializedSignature)
+	for _, msg := range dec.Messages {
+		ms.messages[msg.Address] = msg
+	}
+	return nil
+}
+
+// rehydrate drops any message whose sender is no longer in valSet (the
+// validator set may have changed across an epoch since this set was
+// persisted) and rebuilds the aggregate signature over what remains. It must
+// be called after DecodeRLP, once valSet has been assigned.
+func (ms *messageSet) rehydrate() {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+
+	for addr, msg := range ms.messages {
+		if _, v := ms.valSet.GetByAddress(addr); v == nil {
+			delete(ms.messages, addr)
+			continue
+		}
+		ms.addToAggregate(msg)
+	}
+}
+
+// EncodeRLP implements rlp.Encoder. See messageSet.EncodeRLP; certificates
+// aren't persisted separately since they're derived back from each
+// message's PreparedCertificate field on rehydrate.
+func (ms *qbftMessageSet) EncodeRLP(w io.Writer) error {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+
+	msgs := make([]*istanbul.Message, 0, len(ms.messages))
+	for _, msg := range ms.messages {
+		msgs = append(msgs, msg)
+	}
+	return rlp.Encode(w, &messageSetRLP{Messages: msgs})
+}
+
+// DecodeRLP implements rlp.Decoder. See messageSet.DecodeRLP. The caller
+// must assign valSet and round and call rehydrate before use.
+func (ms *qbftMessageSet) DecodeRLP(s *rlp.Stream) error {
+	var dec messageSetRLP
+	if err := s.Decode(&dec); err != nil {
+		return err
+	}
+
+	ms.messagesMu = new(sync.Mutex)
+	ms.messages = make(map[common.Address]*istanbul.Message, len(dec.Messages))
+	ms.certificates = make(map[common.Address]*istanbul.PiggybackedPreparedCertificate)
+	ms.bitmap = new(big.Int)
+	ms.sigs = make(map[common.Address]blscrypto.SerializedSignature)
+	for _, msg := range dec.Messages {
+		ms.messages[msg.Address] = msg
+	}
+	return nil
+}
+
+// rehydrate drops messages from validators no longer in valSet, restores
+// certificates, and rebuilds the aggregate over what remains. Must be
+// called after DecodeRLP, once valSet and round have been assigned.
+func (ms *qbftMessageSet) rehydrate() {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+
+	for addr, msg := range ms.messages {
+		if _, v := ms.valSet.GetByAddress(addr); v == nil {
+			delete(ms.messages, addr)
+			continue
+		}
+		if msg.PreparedCertificate != nil {
+			ms.certificates[addr] = msg.PreparedCertificate
+		}
+		ms.addToAggregate(msg)
+	}
+}
+
+// MessageSetStore persists in-flight message sets so a validator that
+// restarts mid-round can recover the PREPARE/COMMIT votes it had already
+// collected instead of waiting for peers to re-gossip them. It works with
+// either MessageSet implementation: Put accepts anything satisfying
+// rlp.Encoder, and Get's forkActive argument (the same one passed to
+// newMessageSetFor) picks which concrete type to decode into.
+//
+// NOT YET WIRED UP: nothing in this tree calls Put after a successful Add,
+// or calls Get on startup/round-change to rehydrate. The intended call
+// sites are core's message-handling path (Put right after each Add that
+// returns nil) and core.startNewRound (Get before falling back to a fresh
+// newMessageSetFor, so a restarted validator recovers rather than
+// re-collecting votes from scratch). That driving code (core.go) isn't
+// part of this change.
+type MessageSetStore interface {
+	// Put snapshots ms under the given (sequence, round, msgType) key. ms
+	// must also implement rlp.Encoder (both messageSet and qbftMessageSet
+	// do); a MessageSet that doesn't is a programming error, not persisted.
+	Put(sequence *big.Int, round uint64, msgType uint64, ms MessageSet) error
+	// Get loads the message set stored under (sequence, round, msgType), if
+	// any, re-validating membership against valSet. forkActive selects
+	// which concrete MessageSet implementation to decode into, exactly as
+	// newMessageSetFor does for a freshly constructed set. It returns
+	// (nil, nil) if nothing was stored for that key.
+	Get(sequence *big.Int, round uint64, msgType uint64, valSet istanbul.ValidatorSet, forkActive bool) (MessageSet, error)
+	// DeleteBelow removes every snapshot for a sequence strictly below
+	// sequence, bounding the store's growth to in-flight rounds.
+	DeleteBelow(sequence *big.Int) error
+	// Compact triggers the underlying store's compaction over this store's
+	// key range, reclaiming space freed by DeleteBelow.
+	Compact() error
+}
+
+type messageSetStore struct {
+	db ethdb.KeyValueStore
+}
+
+// NewMessageSetStore wraps db (typically the node's chain database) as a
+// MessageSetStore.
+func NewMessageSetStore(db ethdb.KeyValueStore) MessageSetStore {
+	return &messageSetStore{db: db}
+}
+
+func (s *messageSetStore) Put(sequence *big.Int, round uint64, msgType uint64, ms MessageSet) error {
+	enc, ok := ms.(rlp.Encoder)
+	if !ok {
+		return fmt.Errorf("message set type %T does not support persistence", ms)
+	}
+	var buf bytes.Buffer
+	if err := enc.EncodeRLP(&buf); err != nil {
+		return err
+	}
+	return s.db.Put(messageSetStoreKey(sequence, round, msgType), buf.Bytes())
+}
+
+func (s *messageSetStore) Get(sequence *big.Int, round uint64, msgType uint64, valSet istanbul.ValidatorSet, forkActive bool) (MessageSet, error) {
+	key := messageSetStoreKey(sequence, round, msgType)
+
+	has, err := s.db.Has(key)
+	if err != nil || !has {
+		return nil, err
+	}
+	data, err := s.db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if forkActive {
+		ms := new(qbftMessageSet)
+		if err := rlp.DecodeBytes(data, ms); err != nil {
+			return nil, fmt.Errorf("decode qbft message set at seq %v round %v type %v: %w", sequence, round, msgType, err)
+		}
+		ms.valSet = valSet
+		ms.round = new(big.Int).SetUint64(round)
+		ms.rehydrate()
+		return ms, nil
+	}
+
+	ms := new(messageSet)
+	if err := rlp.DecodeBytes(data, ms); err != nil {
+		return nil, fmt.Errorf("decode message set at seq %v round %v type %v: %w", sequence, round, msgType, err)
+	}
+	ms.valSet = valSet
+	ms.rehydrate()
+	return ms, nil
+}
+
+func (s *messageSetStore) DeleteBelow(sequence *big.Int) error {
+	it := s.db.NewIterator(messageSetStorePrefix, nil)
+	defer it.Release()
+
+	for it.Next() {
+		seq, _, _, err := parseMessageSetStoreKey(it.Key())
+		if err != nil {
+			continue
+		}
+		if seq.Cmp(sequence) < 0 {
+			if err := s.db.Delete(it.Key()); err != nil {
+				return err
+			}
+		}
+	}
+	return it.Error()
+}
+
+func (s *messageSetStore) Compact() error {
+	// The prefix ends in '-', so bumping its last byte gives the first key
+	// past this store's range.
+	limit := append([]byte(nil), messageSetStorePrefix...)
+	limit[len(limit)-1]++
+	return s.db.Compact(messageSetStorePrefix, limit)
+}
+
+// messageSetStoreKey encodes (sequence, round, msgType) as
+// prefix || sequence(32) || round(8) || msgType(8), big-endian, so that
+// iteration naturally groups by sequence.
+func messageSetStoreKey(sequence *big.Int, round uint64, msgType uint64) []byte {
+	key := make([]byte, len(messageSetStorePrefix)+32+8+8)
+	n := copy(key, messageSetStorePrefix)
+	sequence.FillBytes(key[n : n+32])
+	n += 32
+	binary.BigEndian.PutUint64(key[n:n+8], round)
+	n += 8
+	binary.BigEndian.PutUint64(key[n:n+8], msgType)
+	return key
+}
+
+func parseMessageSetStoreKey(key []byte) (sequence *big.Int, round uint64, msgType uint64, err error) {
+	if len(key) != len(messageSetStorePrefix)+32+8+8 || !bytes.HasPrefix(key, messageSetStorePrefix) {
+		return nil, 0, 0, fmt.Errorf("malformed message set key %x", key)
+	}
+	body := key[len(messageSetStorePrefix):]
+	sequence = new(big.Int).SetBytes(body[:32])
+	round = binary.BigEndian.Uint64(body[32:40])
+	msgType = binary.BigEndian.Uint64(body[40:48])
+	return sequence, round, msgType, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+func TestMessageSetStore_PutGetRoundTrip(t *testing.T) {
+	addr := common.HexToAddress("0x1")
+	valSet := newFakeValidatorSet(addr)
+
+	ms := newMessageSet(valSet)
+	if err := ms.Add(newTestMessage(addr)); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	store := NewMessageSetStore(memorydb.New())
+	sequence, round, msgType := big.NewInt(10), uint64(1), uint64(2)
+
+	if err := store.Put(sequence, round, msgType, ms); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	loaded, err := store.Get(sequence, round, msgType, valSet, false)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if loaded == nil {
+		t.Fatal("Get returned nil for a key that was just Put")
+	}
+	if loaded.Get(addr) == nil {
+		t.Errorf("rehydrated set is missing the message for %v", addr)
+	}
+}
+
+func TestMessageSetStore_Get_MissingKeyReturnsNil(t *testing.T) {
+	valSet := newFakeValidatorSet(common.HexToAddress("0x1"))
+	store := NewMessageSetStore(memorydb.New())
+
+	loaded, err := store.Get(big.NewInt(1), 0, 0, valSet, false)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if loaded != nil {
+		t.Errorf("Get for a never-written key = %v, want nil", loaded)
+	}
+}
+
+func TestMessageSetStore_DeleteBelow(t *testing.T) {
+	addr := common.HexToAddress("0x1")
+	valSet := newFakeValidatorSet(addr)
+	ms := newMessageSet(valSet)
+
+	store := NewMessageSetStore(memorydb.New())
+	if err := store.Put(big.NewInt(5), 0, 0, ms); err != nil {
+		t.Fatalf("Put(seq=5): %v", err)
+	}
+	if err := store.Put(big.NewInt(10), 0, 0, ms); err != nil {
+		t.Fatalf("Put(seq=10): %v", err)
+	}
+
+	if err := store.DeleteBelow(big.NewInt(10)); err != nil {
+		t.Fatalf("DeleteBelow: %v", err)
+	}
+
+	if loaded, err := store.Get(big.NewInt(5), 0, 0, valSet, false); err != nil || loaded != nil {
+		t.Errorf("Get(seq=5) after DeleteBelow(10) = (%v, %v), want (nil, nil)", loaded, err)
+	}
+	if loaded, err := store.Get(big.NewInt(10), 0, 0, valSet, false); err != nil || loaded == nil {
+		t.Errorf("Get(seq=10) after DeleteBelow(10) = (%v, %v), want a non-nil set", loaded, err)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/istanbul"
+)
+
+// stubBatchVerifier reports every message in msgs whose address is in bad
+// as failing verification, and never errors out.
+type stubBatchVerifier struct {
+	bad map[common.Address]bool
+}
+
+func (v *stubBatchVerifier) VerifyBatch(msgs []*istanbul.Message) ([]common.Address, error) {
+	var bad []common.Address
+	for _, msg := range msgs {
+		if v.bad[msg.Address] {
+			bad = append(bad, msg.Address)
+		}
+	}
+	return bad, nil
+}
+
+func TestMessageSet_AddDeferredFlushVerify_EvictsOnlyBadSigner(t *testing.T) {
+	good := common.HexToAddress("0x1")
+	bad := common.HexToAddress("0x2")
+	valSet := newFakeValidatorSet(good, bad)
+
+	ms := newMessageSet(valSet)
+	ms.SetBatchVerifier(&stubBatchVerifier{bad: map[common.Address]bool{bad: true}})
+
+	if err := ms.AddDeferred(&istanbul.Message{Address: good}); err != nil {
+		t.Fatalf("AddDeferred(good): %v", err)
+	}
+	if err := ms.AddDeferred(&istanbul.Message{Address: bad}); err != nil {
+		t.Fatalf("AddDeferred(bad): %v", err)
+	}
+
+	badAddrs, err := ms.FlushVerify()
+	if err != nil {
+		t.Fatalf("FlushVerify: %v", err)
+	}
+	if len(badAddrs) != 1 || badAddrs[0] != bad {
+		t.Fatalf("FlushVerify bad = %v, want [%v]", badAddrs, bad)
+	}
+	if ms.Get(good) == nil {
+		t.Errorf("good signer not promoted into the set")
+	}
+	if ms.Get(bad) != nil {
+		t.Errorf("bad signer was promoted into the set")
+	}
+}
+
+func TestMessageSet_Remove_PurgesPendingAndAggregate(t *testing.T) {
+	addr := common.HexToAddress("0x1")
+	valSet := newFakeValidatorSet(addr)
+
+	ms := newMessageSet(valSet)
+	ms.SetBatchVerifier(&stubBatchVerifier{}) // force messages through AddDeferred's pending path
+
+	if err := ms.AddDeferred(&istanbul.Message{Address: addr}); err != nil {
+		t.Fatalf("AddDeferred: %v", err)
+	}
+
+	ms.Remove(addr)
+
+	if _, _, count := ms.Aggregate(); count != 0 {
+		t.Fatalf("Aggregate count = %d, want 0 after Remove", count)
+	}
+	if bad, err := ms.FlushVerify(); err != nil || len(bad) != 0 {
+		t.Fatalf("FlushVerify after Remove = (%v, %v), want no entries left to flush", bad, err)
+	}
+	if ms.Get(addr) != nil {
+		t.Errorf("removed address still promoted by a stale pending entry")
+	}
+}
+
+// TestMessageSet_Add_VerifiesRealCommittedSeal exercises verify/
+// verifySealLocked with a genuine BLS signature rather than an empty seal,
+// which previously took the early len(msg.CommittedSeal) == 0 return and
+// never reached blscrypto.VerifySignature at all. It covers both the
+// accept case (seal signed by the sender's own registered key) and the
+// reject case (seal signed by a different key than the one registered for
+// the claimed sender), so a forged committed seal is actually caught.
+func TestMessageSet_Add_VerifiesRealCommittedSeal(t *testing.T) {
+	good := common.HexToAddress("0x1")
+	forger := common.HexToAddress("0x2")
+	valSet := newFakeValidatorSet(good, forger)
+
+	goodPriv, goodPub, err := newBLSKeyPair()
+	if err != nil {
+		t.Fatalf("newBLSKeyPair(good): %v", err)
+	}
+	valSet.byAddr[good].blsKey = goodPub
+
+	forgerPriv, _, err := newBLSKeyPair()
+	if err != nil {
+		t.Fatalf("newBLSKeyPair(forger): %v", err)
+	}
+	// forger's registered key stays whatever newFakeValidatorSet assigned
+	// it; forgerPriv below deliberately does not match it.
+
+	ms := newMessageSet(valSet)
+
+	msg := &istanbul.Message{Address: good}
+	sig, err := goodPriv.Sign(msg.Hash().Bytes())
+	if err != nil {
+		t.Fatalf("Sign(good): %v", err)
+	}
+	msg.CommittedSeal = sig[:]
+	if err := ms.Add(msg); err != nil {
+		t.Fatalf("Add(genuinely signed message) = %v, want nil", err)
+	}
+	if ms.Get(good) == nil {
+		t.Errorf("genuinely signed message was not admitted")
+	}
+
+	forged := &istanbul.Message{Address: forger}
+	forgedSig, err := forgerPriv.Sign(forged.Hash().Bytes())
+	if err != nil {
+		t.Fatalf("Sign(forger): %v", err)
+	}
+	forged.CommittedSeal = forgedSig[:]
+	if err := ms.Add(forged); err == nil {
+		t.Errorf("Add accepted a committed seal that doesn't match the claimed sender's registered BLS key")
+	}
+	if ms.Get(forger) != nil {
+		t.Errorf("forged message was admitted into the set")
+	}
+}
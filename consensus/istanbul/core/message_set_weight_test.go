@@ -0,0 +1,85 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/istanbul"
+)
+
+func TestMessageSet_WeightAndHasQuorum(t *testing.T) {
+	a, b, c := common.HexToAddress("0x1"), common.HexToAddress("0x2"), common.HexToAddress("0x3")
+	valSet := newFakeValidatorSet(a, b, c)
+
+	ms := newMessageSet(valSet)
+	for _, addr := range []common.Address{a, b} {
+		if err := ms.Add(&istanbul.Message{Address: addr}); err != nil {
+			t.Fatalf("Add(%v): %v", addr, err)
+		}
+	}
+
+	if got := ms.Weight(); got.Cmp(big.NewInt(2)) != 0 {
+		t.Fatalf("Weight() = %v, want 2", got)
+	}
+	if !ms.HasQuorum(big.NewInt(2)) {
+		t.Errorf("HasQuorum(2) = false, want true with 2 contributing validators")
+	}
+	if ms.HasQuorum(big.NewInt(3)) {
+		t.Errorf("HasQuorum(3) = true, want false with only 2 contributing validators")
+	}
+}
+
+// TestMessageSet_Weight_DistinguishesFromHeadcount gives validators unequal
+// weights so Weight()/HasQuorum can't be satisfied by plain Size() math --
+// the defining behavior of stake-weighted quorum. a alone outweighs b and c
+// combined, so the set reaches quorum by weight with a single contributor
+// while still falling short of a naive 2-out-of-3 headcount quorum.
+func TestMessageSet_Weight_DistinguishesFromHeadcount(t *testing.T) {
+	a, b, c := common.HexToAddress("0x1"), common.HexToAddress("0x2"), common.HexToAddress("0x3")
+	valSet := newFakeValidatorSetWeighted(
+		[]common.Address{a, b, c},
+		[]*big.Int{big.NewInt(5), big.NewInt(1), big.NewInt(1)},
+	)
+
+	ms := newMessageSet(valSet)
+	if err := ms.Add(&istanbul.Message{Address: a}); err != nil {
+		t.Fatalf("Add(a): %v", err)
+	}
+
+	if got := ms.Weight(); got.Cmp(big.NewInt(5)) != 0 {
+		t.Fatalf("Weight() with only a contributing = %v, want 5", got)
+	}
+	if ms.Size() != 1 {
+		t.Fatalf("Size() = %d, want 1", ms.Size())
+	}
+	if !ms.HasQuorum(big.NewInt(5)) {
+		t.Errorf("HasQuorum(5) = false, want true: a's weight alone meets the threshold")
+	}
+
+	if err := ms.Add(&istanbul.Message{Address: b}); err != nil {
+		t.Fatalf("Add(b): %v", err)
+	}
+	if got := ms.Weight(); got.Cmp(big.NewInt(6)) != 0 {
+		t.Fatalf("Weight() with a and b contributing = %v, want 6 (not Size()*avg)", got)
+	}
+	if ms.HasQuorum(big.NewInt(7)) {
+		t.Errorf("HasQuorum(7) = true, want false: a+b's combined weight is only 6")
+	}
+}
@@ -0,0 +1,310 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/istanbul"
+	"github.com/ethereum/go-ethereum/crypto/bls/blscrypto"
+)
+
+// newQBFTMessageSet constructs a message set for a round at or after the
+// QBFT fork block. It understands QBFT's distinct message encoding
+// (PRE-PREPARE / PREPARE / COMMIT / ROUND-CHANGE, the latter optionally
+// carrying a piggybacked prepared certificate) and its commit seal domain,
+// which includes the round number alongside the message hash. round is the
+// round this set was created for, and is folded into the commit seal domain
+// by verify; it comes from the same round/view that scopes the set in
+// roundState.
+func newQBFTMessageSet(valSet istanbul.ValidatorSet, round *big.Int) *qbftMessageSet {
+	return &qbftMessageSet{
+		messagesMu:   new(sync.Mutex),
+		messages:     make(map[common.Address]*istanbul.Message),
+		certificates: make(map[common.Address]*istanbul.PiggybackedPreparedCertificate),
+		valSet:       valSet,
+		round:        round,
+		bitmap:       new(big.Int),
+		sigs:         make(map[common.Address]blscrypto.SerializedSignature),
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+type qbftMessageSet struct {
+	valSet     istanbul.ValidatorSet
+	round      *big.Int
+	messagesMu *sync.Mutex
+	messages   map[common.Address]*istanbul.Message
+
+	// certificates holds the prepared certificate piggybacked on a
+	// ROUND-CHANGE message, when the sender has one. It is empty for
+	// PRE-PREPARE/PREPARE/COMMIT sets.
+	certificates map[common.Address]*istanbul.PiggybackedPreparedCertificate
+
+	// aggSig/bitmap/sigs mirror messageSet's aggregate bookkeeping (see
+	// message_set.go) so that activating the QBFT fork doesn't silently
+	// drop Aggregate()/Weight()/HasQuorum() for downstream callers written
+	// against the MessageSet interface.
+	aggSig blscrypto.SerializedSignature
+	bitmap *big.Int
+	sigs   map[common.Address]blscrypto.SerializedSignature
+}
+
+func (ms *qbftMessageSet) Add(msg *istanbul.Message) error {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+
+	if err := ms.verify(msg); err != nil {
+		return err
+	}
+
+	return ms.addVerifiedMessage(msg)
+}
+
+func (ms *qbftMessageSet) GetAddressIndex(addr common.Address) (uint64, error) {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+
+	i, v := ms.valSet.GetByAddress(addr)
+	if v == nil {
+		return 0, istanbul.ErrUnauthorizedAddress
+	}
+
+	return uint64(i), nil
+}
+
+func (ms *qbftMessageSet) GetAddressPublicKey(addr common.Address) ([]byte, error) {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+
+	_, v := ms.valSet.GetByAddress(addr)
+	if v == nil {
+		return nil, istanbul.ErrUnauthorizedAddress
+	}
+
+	return v.BLSPublicKey(), nil
+}
+
+func (ms *qbftMessageSet) ValSetSize() uint64 {
+	return uint64(ms.valSet.Size())
+}
+
+func (ms *qbftMessageSet) Remove(address common.Address) {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+
+	delete(ms.messages, address)
+	delete(ms.certificates, address)
+
+	if _, ok := ms.sigs[address]; !ok {
+		return
+	}
+	delete(ms.sigs, address)
+
+	if idx, v := ms.valSet.GetByAddress(address); v != nil {
+		ms.bitmap.SetBit(ms.bitmap, idx, 0)
+	}
+
+	ms.rebuildAggregateLocked()
+}
+
+// Aggregate returns the current aggregated BLS signature over every
+// well-formed committed seal added so far, alongside the bitmap of
+// contributing validator indices and the number of contributors. See
+// messageSet.Aggregate.
+func (ms *qbftMessageSet) Aggregate() (sig []byte, bitmap *big.Int, count int) {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+
+	return ms.aggSig[:], new(big.Int).Set(ms.bitmap), len(ms.sigs)
+}
+
+// Weight returns the combined voting weight of every validator that has
+// contributed a message to the set. See messageSet.Weight.
+func (ms *qbftMessageSet) Weight() *big.Int {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+
+	weight := new(big.Int)
+	for addr := range ms.messages {
+		weight.Add(weight, ms.valSet.WeightOf(addr))
+	}
+	return weight
+}
+
+// HasQuorum reports whether the combined weight of contributing validators
+// meets or exceeds threshold. See messageSet.HasQuorum.
+func (ms *qbftMessageSet) HasQuorum(threshold *big.Int) bool {
+	return ms.Weight().Cmp(threshold) >= 0
+}
+
+// addToAggregate folds msg's committed seal into the running aggregate in
+// O(1). See messageSet.addToAggregate; the logic is identical, only the
+// commit seal domain (commitSealDigest) differs between the two variants.
+// Must be called with messagesMu held.
+func (ms *qbftMessageSet) addToAggregate(msg *istanbul.Message) {
+	if len(msg.CommittedSeal) == 0 {
+		return
+	}
+
+	var sig blscrypto.SerializedSignature
+	if len(msg.CommittedSeal) != len(sig) {
+		return
+	}
+	copy(sig[:], msg.CommittedSeal)
+
+	idx, v := ms.valSet.GetByAddress(msg.Address)
+	if v == nil {
+		return
+	}
+	if _, ok := ms.sigs[msg.Address]; ok {
+		return
+	}
+
+	newAgg, err := ms.combineLocked(sig)
+	if err != nil {
+		return
+	}
+
+	ms.sigs[msg.Address] = sig
+	ms.bitmap.SetBit(ms.bitmap, idx, 1)
+	ms.aggSig = newAgg
+}
+
+// combineLocked folds sig into the current aggregate in O(1). See
+// messageSet.combineLocked. Must be called with messagesMu held.
+func (ms *qbftMessageSet) combineLocked(sig blscrypto.SerializedSignature) (blscrypto.SerializedSignature, error) {
+	if len(ms.sigs) == 0 {
+		return sig, nil
+	}
+	return blscrypto.AggregateSignatures([]blscrypto.SerializedSignature{ms.aggSig, sig})
+}
+
+// rebuildAggregateLocked recomputes aggSig from the currently known
+// per-address signatures; used by Remove only. See
+// messageSet.rebuildAggregateLocked. Must be called with messagesMu held.
+func (ms *qbftMessageSet) rebuildAggregateLocked() {
+	if len(ms.sigs) == 0 {
+		ms.aggSig = blscrypto.SerializedSignature{}
+		return
+	}
+
+	sigs := make([]blscrypto.SerializedSignature, 0, len(ms.sigs))
+	for _, s := range ms.sigs {
+		sigs = append(sigs, s)
+	}
+
+	aggSig, err := blscrypto.AggregateSignatures(sigs)
+	if err != nil {
+		return
+	}
+	ms.aggSig = aggSig
+}
+
+func (ms *qbftMessageSet) Values() (result []*istanbul.Message) {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+
+	for _, v := range ms.messages {
+		result = append(result, v)
+	}
+
+	return result
+}
+
+func (ms *qbftMessageSet) Size() int {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+	return len(ms.messages)
+}
+
+func (ms *qbftMessageSet) Get(addr common.Address) *istanbul.Message {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+	return ms.messages[addr]
+}
+
+// PreparedCertificate returns the prepared certificate piggybacked on addr's
+// ROUND-CHANGE message, if any. It is QBFT-specific, so it is exposed on the
+// concrete type rather than the shared MessageSet interface.
+func (ms *qbftMessageSet) PreparedCertificate(addr common.Address) *istanbul.PiggybackedPreparedCertificate {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+	return ms.certificates[addr]
+}
+
+// ----------------------------------------------------------------------------
+
+// verify checks that msg comes from a known validator and, for messages
+// carrying a committed seal (COMMIT), that the seal was produced over the
+// QBFT domain (message hash plus round number), unlike classic Istanbul
+// which seals only the message hash.
+func (ms *qbftMessageSet) verify(msg *istanbul.Message) error {
+	_, v := ms.valSet.GetByAddress(msg.Address)
+	if v == nil {
+		return istanbul.ErrUnauthorizedAddress
+	}
+
+	if len(msg.CommittedSeal) == 0 {
+		return nil
+	}
+
+	var sig blscrypto.SerializedSignature
+	if len(msg.CommittedSeal) != len(sig) {
+		return errInvalidCommittedSeal
+	}
+	copy(sig[:], msg.CommittedSeal)
+
+	return blscrypto.VerifySignature(v.BLSPublicKey(), ms.commitSealDigest(msg), sig)
+}
+
+// commitSealDigest is the QBFT commit seal domain: the message digest with
+// the round number appended, so a seal produced for one round can't be
+// replayed as valid for another. Classic Istanbul (messageSet.verifySealLocked)
+// seals msg.Hash() alone.
+func (ms *qbftMessageSet) commitSealDigest(msg *istanbul.Message) []byte {
+	hash := msg.Hash()
+	digest := make([]byte, len(hash)+8)
+	copy(digest, hash.Bytes())
+	binary.BigEndian.PutUint64(digest[len(hash):], ms.round.Uint64())
+	return digest
+}
+
+func (ms *qbftMessageSet) addVerifiedMessage(msg *istanbul.Message) error {
+	ms.messages[msg.Address] = msg
+	if msg.PreparedCertificate != nil {
+		ms.certificates[msg.Address] = msg.PreparedCertificate
+	}
+	ms.addToAggregate(msg)
+	return nil
+}
+
+func (ms *qbftMessageSet) String() string {
+	ms.messagesMu.Lock()
+	defer ms.messagesMu.Unlock()
+	addresses := make([]string, 0, len(ms.messages))
+	for _, v := range ms.messages {
+		addresses = append(addresses, v.Address.String())
+	}
+	return fmt.Sprintf("[<%v> %v]", len(ms.messages), strings.Join(addresses, ", "))
+}
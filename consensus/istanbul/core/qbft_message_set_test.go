@@ -0,0 +1,74 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/istanbul"
+)
+
+func newTestMessage(addr common.Address) *istanbul.Message {
+	return &istanbul.Message{Address: addr}
+}
+
+func TestNewMessageSetFor_PicksImplementationByForkActive(t *testing.T) {
+	valSet := newFakeValidatorSet(common.HexToAddress("0x1"))
+
+	if _, ok := newMessageSetFor(valSet, big.NewInt(0), false).(*messageSet); !ok {
+		t.Errorf("newMessageSetFor(forkActive=false) did not return *messageSet")
+	}
+	if _, ok := newMessageSetFor(valSet, big.NewInt(1), true).(*qbftMessageSet); !ok {
+		t.Errorf("newMessageSetFor(forkActive=true) did not return *qbftMessageSet")
+	}
+}
+
+func TestQBFTMessageSet_CommitSealDigestVariesByRound(t *testing.T) {
+	addr := common.HexToAddress("0x1")
+	valSet := newFakeValidatorSet(addr)
+
+	round1 := newQBFTMessageSet(valSet, big.NewInt(1))
+	round2 := newQBFTMessageSet(valSet, big.NewInt(2))
+
+	msg := newTestMessage(addr)
+
+	d1 := round1.commitSealDigest(msg)
+	d2 := round2.commitSealDigest(msg)
+
+	if string(d1) == string(d2) {
+		t.Errorf("commit seal digest is the same across rounds 1 and 2; the QBFT domain must include the round")
+	}
+}
+
+func TestQBFTMessageSet_WeightAndAggregateTrackContributors(t *testing.T) {
+	a, b := common.HexToAddress("0x1"), common.HexToAddress("0x2")
+	valSet := newFakeValidatorSet(a, b)
+	ms := newQBFTMessageSet(valSet, big.NewInt(1))
+
+	if err := ms.Add(newTestMessage(a)); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	if got := ms.Weight(); got.Cmp(big.NewInt(1)) != 0 {
+		t.Fatalf("Weight() = %v, want 1", got)
+	}
+	if _, _, count := ms.Aggregate(); count != 0 {
+		t.Fatalf("Aggregate count = %d, want 0 since the message carries no committed seal", count)
+	}
+}